@@ -5,30 +5,254 @@
 // instead of log.Print*.
 // Use trace.Token to retrieve unique token for request (for example to write it in response body/header).
 //
+// By default request events are logged through the standard library log
+// package, but any structured logger can be plugged in with SetLogger or
+// WithLogger, as long as it implements the Logger interface (which
+// *log/slog.Logger satisfies directly).
+//
+// To propagate the token to calls made while handling a request, use
+// trace.Transport (or trace.Client) as the http.RoundTripper for any
+// downstream HTTP client.
+//
 // This library was created to help debugging services that handle multiple concurrent requests and
 // be able to extract only relevant logs for it.
 package trace
 
 import (
-	"bufio"
-	"crypto/md5"
-	"errors"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
-	"strconv"
+	"os"
+	"runtime/debug"
 	"strings"
 	"time"
+)
 
-	"github.com/gorilla/context"
+type contextKey int
+
+const (
+	requestTokenKey contextKey = iota
+	loggerKey
+	traceparentKey
 )
 
-const requestTokenKey = "_token"
+// Logger is the interface trace uses to emit request events. It matches
+// (*log/slog.Logger).Log, so a *slog.Logger can be passed directly; zap and
+// logrus users can satisfy it with a small adapter.
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...interface{})
+}
+
+// stdLogger adapts the standard library log package to Logger. It's the
+// default used by trace, so existing callers of Log/Logln/Logf, and the
+// structured events emitted by Handler/New/Transport, keep being prefixed
+// with the request token and keep their fields visible without switching to
+// a structured logger.
+type stdLogger struct{}
+
+func (stdLogger) Log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	tok, _ := FromContext(ctx)
+	parts := make([]interface{}, 0, 2+len(args)/2)
+	if tok != "" {
+		parts = append(parts, tok)
+	}
+	parts = append(parts, msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		parts = append(parts, fmt.Sprintf("%v=%v", args[i], args[i+1]))
+	}
+	log.Println(parts...)
+}
+
+var defaultLogger Logger = stdLogger{}
+
+// SetLogger replaces the package-wide default Logger used by Handler and the
+// package-level Log/Logln/Logf functions.
+func SetLogger(l Logger) {
+	defaultLogger = l
+}
+
+// WithLogger wraps h so that requests flowing through it use l instead of the
+// package-wide default logger set via SetLogger.
+func WithLogger(h http.Handler, l Logger) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), loggerKey, l)
+		h.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+func loggerFromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey).(Logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// RequestIDHeader is the header used to read an inbound request id from and
+// to echo the chosen token back to the client. It's also the header trace
+// uses to propagate the token to downstream services, see OutgoingHeaders.
+var RequestIDHeader = "X-Request-Id"
+
+// traceparentHeader is the W3C trace context header trace understands, see
+// https://www.w3.org/TR/trace-context/#traceparent-header.
+const traceparentHeader = "traceparent"
+
+// TokenSource produces the token used to trace r. The default, used by
+// Handler and friends, reuses an inbound X-Request-Id/traceparent header
+// when present and otherwise mints a random one.
+type TokenSource func(r *http.Request) string
+
+// DefaultTokenSource is the TokenSource used by Handler, NoLogHandler and
+// KVPHandler.
+var DefaultTokenSource TokenSource = defaultTokenSource
+
+// defaultTokenSource reuses the trace-id from an inbound traceparent header
+// or the raw value of RequestIDHeader when either is present, so that a
+// token minted upstream keeps being grep-able across services. It falls
+// back to a random ID when neither is set.
+func defaultTokenSource(r *http.Request) string {
+	if tp := r.Header.Get(traceparentHeader); tp != "" {
+		if traceID, _, _, ok := parseTraceparent(tp); ok {
+			return traceID
+		}
+	}
+	if id := r.Header.Get(RequestIDHeader); id != "" {
+		return id
+	}
+	return randomHex(16)
+}
+
+// randomHex returns n random bytes hex-encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand.Read on the standard reader only fails if the
+		// underlying OS source is broken, in which case there's nothing
+		// better trace can do than fall back to a fixed-width zero token
+		// rather than panicking on every request.
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent parses a W3C traceparent header of the form
+// "00-<32hex trace-id>-<16hex span-id>-<2hex flags>".
+func parseTraceparent(v string) (traceID, spanID, flags string, ok bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 {
+		return "", "", "", false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return "", "", "", false
+	}
+	if !isHex(traceID) || !isHex(spanID) || !isHex(flags) {
+		return "", "", "", false
+	}
+	return traceID, spanID, flags, true
+}
+
+// formatTraceparent renders a traceparent header value for traceID/spanID/flags.
+func formatTraceparent(traceID, spanID, flags string) string {
+	return "00-" + traceID + "-" + spanID + "-" + flags
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'f':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// outgoingTraceparent builds the traceparent header to forward downstream of
+// r, carrying the trace-id along with a freshly minted span-id for this hop.
+// It returns "" when there's nothing sensible to propagate, e.g. token isn't
+// a valid 32 hex char trace-id and r didn't carry a traceparent itself.
+func outgoingTraceparent(r *http.Request, token string) string {
+	if tp := r.Header.Get(traceparentHeader); tp != "" {
+		if traceID, _, flags, ok := parseTraceparent(tp); ok {
+			return formatTraceparent(traceID, randomHex(8), flags)
+		}
+	}
+	if len(token) == 32 && isHex(token) {
+		return formatTraceparent(token, randomHex(8), "01")
+	}
+	return ""
+}
 
+// withTraceparent returns a copy of ctx carrying tp as the traceparent to
+// forward to downstream services, see OutgoingHeadersForContext.
+func withTraceparent(ctx context.Context, tp string) context.Context {
+	return context.WithValue(ctx, traceparentKey, tp)
+}
+
+func traceparentFromContext(ctx context.Context) (string, bool) {
+	tp, ok := ctx.Value(traceparentKey).(string)
+	return tp, ok
+}
+
+// OutgoingHeadersForContext returns the headers that should be attached to an
+// outbound HTTP request in order to propagate ctx's trace to a downstream
+// service: the current token as RequestIDHeader, and a traceparent header
+// when one was derived for ctx (see Handler/New). Transport and Client use
+// this to stamp outbound requests that only carry a context.Context, not the
+// original *http.Request.
+func OutgoingHeadersForContext(ctx context.Context) http.Header {
+	h := make(http.Header)
+	token, ok := FromContext(ctx)
+	if !ok || token == "" {
+		return h
+	}
+	h.Set(RequestIDHeader, token)
+	if tp, ok := traceparentFromContext(ctx); ok && tp != "" {
+		h.Set(traceparentHeader, tp)
+	}
+	return h
+}
+
+// OutgoingHeaders returns the headers that should be attached to an outbound
+// HTTP request in order to propagate r's trace to a downstream service: the
+// current token as RequestIDHeader, and a traceparent header when one can be
+// derived from r.
+func OutgoingHeaders(r *http.Request) http.Header {
+	h := OutgoingHeadersForContext(r.Context())
+	if h.Get(traceparentHeader) == "" {
+		if tp := outgoingTraceparent(r, Token(r)); tp != "" {
+			h.Set(traceparentHeader, tp)
+		}
+	}
+	return h
+}
+
+// newRequestContext stamps r's context with token and, when derivable, the
+// traceparent to forward to downstream services.
+func newRequestContext(r *http.Request, token string) context.Context {
+	ctx := NewContext(r.Context(), token)
+	if tp := outgoingTraceparent(r, token); tp != "" {
+		ctx = withTraceparent(ctx, tp)
+	}
+	return ctx
+}
+
+// statusRecorder records the status and byte count of a response as it's
+// written. wrapResponseWriter pairs it with whichever of
+// http.Flusher/http.Hijacker/http.Pusher/http.CloseNotifier the wrapped writer
+// itself implements, so that downstream type-assertions for those optional
+// interfaces keep behaving the way they would against the unwrapped writer;
+// when the wrapped writer implements none of them, the statusRecorder itself
+// is the http.ResponseWriter handed on.
 type statusRecorder struct {
 	http.ResponseWriter
-	status int
+	status  int
+	written int64
 }
 
 func (sr *statusRecorder) WriteHeader(status int) {
@@ -36,131 +260,464 @@ func (sr *statusRecorder) WriteHeader(status int) {
 	sr.ResponseWriter.WriteHeader(status)
 }
 
-func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hj, ok := sr.ResponseWriter.(http.Hijacker); ok {
-		return hj.Hijack()
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	// A Write before WriteHeader sends an implicit 200.
+	if sr.status == 0 {
+		sr.status = http.StatusOK
 	}
-
-	return nil, nil, errors.New("Hijack not supported")
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
 }
 
-func (sr statusRecorder) getStatus() string {
+func (sr *statusRecorder) getStatusCode() int {
 	if sr.status == 0 {
-		sr.status = http.StatusOK
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// wrapResponseWriter wraps rw in a statusRecorder, returning a writer that
+// implements exactly the combination of http.Flusher, http.Hijacker,
+// http.Pusher and http.CloseNotifier that rw itself implements (the
+// felixge/httpsnoop approach), plus the statusRecorder itself for later
+// inspection of the recorded status/byte count.
+func wrapResponseWriter(rw http.ResponseWriter) (http.ResponseWriter, *statusRecorder) {
+	sr := &statusRecorder{ResponseWriter: rw}
+
+	flusher, isFlusher := rw.(http.Flusher)
+	hijacker, isHijacker := rw.(http.Hijacker)
+	pusher, isPusher := rw.(http.Pusher)
+	closeNotifier, isCloseNotifier := rw.(http.CloseNotifier)
+
+	switch {
+	case isFlusher && isHijacker && isPusher && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{sr, flusher, hijacker, pusher, closeNotifier}, sr
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{sr, flusher, hijacker, pusher}, sr
+	case isFlusher && isHijacker && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{sr, flusher, hijacker, closeNotifier}, sr
+	case isFlusher && isPusher && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Pusher
+			http.CloseNotifier
+		}{sr, flusher, pusher, closeNotifier}, sr
+	case isHijacker && isPusher && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{sr, hijacker, pusher, closeNotifier}, sr
+	case isFlusher && isHijacker:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Hijacker
+		}{sr, flusher, hijacker}, sr
+	case isFlusher && isPusher:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.Pusher
+		}{sr, flusher, pusher}, sr
+	case isFlusher && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Flusher
+			http.CloseNotifier
+		}{sr, flusher, closeNotifier}, sr
+	case isHijacker && isPusher:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+			http.Pusher
+		}{sr, hijacker, pusher}, sr
+	case isHijacker && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+			http.CloseNotifier
+		}{sr, hijacker, closeNotifier}, sr
+	case isPusher && isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.Pusher
+			http.CloseNotifier
+		}{sr, pusher, closeNotifier}, sr
+	case isFlusher:
+		return struct {
+			*statusRecorder
+			http.Flusher
+		}{sr, flusher}, sr
+	case isHijacker:
+		return struct {
+			*statusRecorder
+			http.Hijacker
+		}{sr, hijacker}, sr
+	case isPusher:
+		return struct {
+			*statusRecorder
+			http.Pusher
+		}{sr, pusher}, sr
+	case isCloseNotifier:
+		return struct {
+			*statusRecorder
+			http.CloseNotifier
+		}{sr, closeNotifier}, sr
+	default:
+		return sr, sr
 	}
-	return strconv.Itoa(sr.status) + " " + http.StatusText(sr.status)
 }
 
-// Handler wraps h, generating new token for it.
-// It also logs request beginning and ending.
-// gorilla/context.Clear is called after handler is done.
+// NewContext returns a copy of ctx carrying token as the request token.
+func NewContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, requestTokenKey, token)
+}
+
+// FromContext returns the request token stored in ctx, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(requestTokenKey).(string)
+	return token, ok
+}
+
+// Handler wraps h, generating new token for it (reusing an inbound
+// X-Request-Id/traceparent header when present, see DefaultTokenSource) and
+// storing it in the request's context. It also echoes the token back to the
+// client via RequestIDHeader and logs request beginning and ending as
+// structured events via the current Logger (see SetLogger/WithLogger).
 func Handler(h http.Handler) http.Handler {
-	return context.ClearHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		token := fmt.Sprintf("%x", md5.Sum([]byte(r.URL.String()+r.RemoteAddr+time.Now().String())))
-		context.Set(r, requestTokenKey, token)
-		Logln(r, "new request", r.Method, r.URL)
-		sr := &statusRecorder{ResponseWriter: rw}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token := DefaultTokenSource(r)
+		r = r.WithContext(newRequestContext(r, token))
+		rw.Header().Set(RequestIDHeader, token)
+		l := loggerFromContext(r.Context())
+		l.Log(r.Context(), slog.LevelInfo, "new request",
+			"method", r.Method, "url", r.URL.String(), "request_id", token, "remote_addr", r.RemoteAddr)
+		wrapped, sr := wrapResponseWriter(rw)
 		start := time.Now()
-		h.ServeHTTP(sr, r)
-		Logln(r, "done, status:", sr.getStatus(), "time:", time.Since(start))
-	}))
+		h.ServeHTTP(wrapped, r)
+		l.Log(r.Context(), slog.LevelInfo, "done",
+			"method", r.Method, "url", r.URL.String(), "status", sr.getStatusCode(),
+			"duration_ms", time.Since(start).Milliseconds(), "request_id", token,
+			"remote_addr", r.RemoteAddr, "bytes_written", sr.written)
+	})
 }
 
 // NoLogHandler is like Handler but it doesn't do any logging.
 func NoLogHandler(h http.Handler) http.Handler {
-	return context.ClearHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		token := fmt.Sprintf("%x", md5.Sum([]byte(r.URL.String()+r.RemoteAddr+time.Now().String())))
-		context.Set(r, requestTokenKey, token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token := DefaultTokenSource(r)
+		r = r.WithContext(newRequestContext(r, token))
+		rw.Header().Set(RequestIDHeader, token)
 		h.ServeHTTP(rw, r)
-	}))
+	})
 }
 
-// NoClearHandler is like Handler but it doesn't clear gorilla/context.
+// NoClearHandler is like Handler.
+//
+// Deprecated: now that the token is stored in the request's context.Context
+// instead of gorilla/context, there is nothing to clear. Use Handler instead.
 func NoClearHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		token := fmt.Sprintf("%x", md5.Sum([]byte(r.URL.String()+r.RemoteAddr+time.Now().String())))
-		context.Set(r, requestTokenKey, token)
-		Logln(r, "new request", r.Method, r.URL)
-		sr := &statusRecorder{ResponseWriter: rw}
-		start := time.Now()
-		h.ServeHTTP(sr, r)
-		Logln(r, "done, status:", sr.getStatus(), "time:", time.Since(start))
-	})
+	return Handler(h)
 }
 
-// NoLogClearHandler is like Handler but it doesn't do any logging and doesn't clear gorilla/context.
+// NoLogClearHandler is like NoLogHandler.
+//
+// Deprecated: now that the token is stored in the request's context.Context
+// instead of gorilla/context, there is nothing to clear. Use NoLogHandler instead.
 func NoLogClearHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		token := fmt.Sprintf("%x", md5.Sum([]byte(r.URL.String()+r.RemoteAddr+time.Now().String())))
-		context.Set(r, requestTokenKey, token)
-		h.ServeHTTP(rw, r)
-	})
+	return NoLogHandler(h)
 }
 
-// KVPHandler is like Handler but logs the token as key-value pair.
-// This means that instead of
-//     [timestamp] [token] [message]
-// you will see
-//     [timestamp] request_id=[token] [message]
+// kvpLogger is a Logger backed by slog's text handler, which renders fields
+// as "key=value" pairs, e.g. "request_id=abc123".
+var kvpLogger Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// KVPHandler is like Handler but logs the token (and every other field) as a
+// "key=value" pair, e.g. instead of
+//
+//	[timestamp] [token] [message]
+//
+// you get
+//
+//	time=... level=INFO msg="new request" method=... url=... request_id=[token] ...
 //
 // This format is easier to deal with using log parsing systems, such as Splunk.
 func KVPHandler(h http.Handler) http.Handler {
-	return context.ClearHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		token := fmt.Sprintf("request_id=%x", md5.Sum([]byte(r.URL.String()+r.RemoteAddr+time.Now().String())))
-		context.Set(r, requestTokenKey, token)
-		Logln(r, "new request", r.Method, r.URL)
-		sr := &statusRecorder{ResponseWriter: rw}
-		start := time.Now()
-		h.ServeHTTP(sr, r)
-		Logln(r, "done, status:", sr.getStatus(), "time:", time.Since(start))
-	}))
+	return WithLogger(Handler(h), kvpLogger)
 }
 
-// Token returns generated token for request or empty string it's not present.
-// The returned token is formatted as a key-value pair, e.g.
-// "request_id=token". If you need just the token not in KVP form, use
-// TokenPlain.
+// config holds the settings built up by Option functions passed to New.
+type config struct {
+	logging        bool
+	tokenSource    TokenSource
+	sampler        func(*http.Request) bool
+	headerRedactor func(http.Header)
+	panicRecovery  bool
+	skipPaths      map[string]struct{}
+}
+
+// Option configures the middleware returned by New.
+type Option func(*config)
+
+// WithLogging enables or disables the request start/done log events. It's
+// enabled by default.
+func WithLogging(enabled bool) Option {
+	return func(c *config) { c.logging = enabled }
+}
+
+// WithTokenSource overrides the TokenSource used to mint/reuse the request
+// token. Defaults to DefaultTokenSource.
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *config) { c.tokenSource = ts }
+}
+
+// WithSampler restricts logging to requests for which sample returns true,
+// e.g. for head-based sampling:
 //
-// The reason for this to prepend "request_id=" is to match our logging format
-// and make log parsing easier.
-func Token(r *http.Request) string {
-	tok := context.Get(r, requestTokenKey)
-	if toks, ok := tok.(string); ok {
-		return toks
+//	trace.WithSampler(func(r *http.Request) bool { return rand.Intn(100) == 0 })
+//
+// The token is still generated and stored in the request's context for
+// unsampled requests; only the start/done log events are skipped.
+func WithSampler(sample func(r *http.Request) bool) Option {
+	return func(c *config) { c.sampler = sample }
+}
+
+// WithHeaderRedactor runs redact on the request's headers before the
+// handler chain sees them, e.g. to strip Authorization before any logging
+// middleware downstream has a chance to record it.
+func WithHeaderRedactor(redact func(http.Header)) Option {
+	return func(c *config) { c.headerRedactor = redact }
+}
+
+// WithPanicRecovery enables recovering from panics raised by the wrapped
+// handler: the stack is logged alongside the request token and the client
+// receives a 500 instead of the connection being closed, unless the handler
+// had already started writing its response. Disabled by default.
+func WithPanicRecovery(enabled bool) Option {
+	return func(c *config) { c.panicRecovery = enabled }
+}
+
+// WithSkipPaths disables tracing entirely (no token, no logging) for
+// requests whose URL path exactly matches one of paths, e.g. "/healthz".
+func WithSkipPaths(paths []string) Option {
+	return func(c *config) {
+		c.skipPaths = make(map[string]struct{}, len(paths))
+		for _, p := range paths {
+			c.skipPaths[p] = struct{}{}
+		}
 	}
-	return ""
 }
 
-// TokenPlain returns generated token for request or empty string it's not present.
-// In case token is not formatted correctly, TokenPlain panics.
-func TokenPlain(r *http.Request) string {
-	tok := context.Get(r, requestTokenKey)
-	toks, ok := tok.(string)
-	if !ok {
-		return ""
+// New builds a middleware from opts, replacing the four Handler variants
+// above with a single composable constructor. With no options, New matches
+// Handler: logging on, DefaultTokenSource, no sampling, no panic
+// recovery, no skipped paths.
+func New(opts ...Option) func(http.Handler) http.Handler {
+	cfg := config{
+		logging:     true,
+		tokenSource: DefaultTokenSource,
 	}
-	parts := strings.Split(toks, "=")
-	if len(parts) != 2 {
-		panic("trace: malformed request token: " + toks)
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	return parts[1]
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if _, skip := cfg.skipPaths[r.URL.Path]; skip {
+				h.ServeHTTP(rw, r)
+				return
+			}
+
+			if cfg.headerRedactor != nil {
+				cfg.headerRedactor(r.Header)
+			}
+
+			token := cfg.tokenSource(r)
+			r = r.WithContext(newRequestContext(r, token))
+			rw.Header().Set(RequestIDHeader, token)
+
+			logEnabled := cfg.logging && (cfg.sampler == nil || cfg.sampler(r))
+			l := loggerFromContext(r.Context())
+
+			wrapped, sr := wrapResponseWriter(rw)
+			start := time.Now()
+			defer func() {
+				if cfg.panicRecovery {
+					if rec := recover(); rec != nil {
+						if sr.status == 0 {
+							sr.WriteHeader(http.StatusInternalServerError)
+						}
+						l.Log(r.Context(), slog.LevelError, "panic recovered",
+							"method", r.Method, "url", r.URL.String(), "request_id", token,
+							"panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+					}
+				}
+				if logEnabled {
+					l.Log(r.Context(), slog.LevelInfo, "done",
+						"method", r.Method, "url", r.URL.String(), "status", sr.getStatusCode(),
+						"duration_ms", time.Since(start).Milliseconds(), "request_id", token,
+						"remote_addr", r.RemoteAddr, "bytes_written", sr.written)
+				}
+			}()
+
+			if logEnabled {
+				l.Log(r.Context(), slog.LevelInfo, "new request",
+					"method", r.Method, "url", r.URL.String(), "request_id", token, "remote_addr", r.RemoteAddr)
+			}
+			h.ServeHTTP(wrapped, r)
+		})
+	}
+}
+
+// Chain is New under a name that reads naturally alongside alice-style
+// middleware chains, since the func(http.Handler) http.Handler it returns is
+// exactly alice's Constructor type:
+//
+//	alice.New(trace.Chain(trace.WithPanicRecovery(true)), other...).Then(handler)
+func Chain(opts ...Option) func(http.Handler) http.Handler {
+	return New(opts...)
+}
+
+// Token returns generated token for request or empty string it's not present.
+func Token(r *http.Request) string {
+	tok, _ := FromContext(r.Context())
+	return tok
+}
+
+// TokenPlain is a synonym for Token kept for backward compatibility with
+// code written against the old KVPHandler, which used to store the token
+// prefixed as "request_id=token"; Token itself has always returned the
+// unprefixed value for every other handler. If toks is still prefixed that
+// way, TokenPlain strips the prefix.
+func TokenPlain(r *http.Request) string {
+	toks := Token(r)
+	return strings.TrimPrefix(toks, "request_id=")
 }
 
-// Log forwards vals to log.Print and prepends request token
+// Log forwards vals to the current Logger (log.Print by default, see
+// SetLogger). The default logger prepends the request token; any other
+// Logger gets it only through the request's context (see FromContext).
 func Log(r *http.Request, vals ...interface{}) {
-	tok := Token(r)
-	log.Print(append([]interface{}{tok}, vals...)...)
+	LogCtx(r.Context(), vals...)
 }
 
-// Logln forwards vals to log.Println and prepends request token
+// Logln forwards vals to the current Logger (log.Println by default, see
+// SetLogger). The default logger prepends the request token; any other
+// Logger gets it only through the request's context (see FromContext).
 func Logln(r *http.Request, vals ...interface{}) {
-	tok := Token(r)
-	log.Println(append([]interface{}{tok}, vals...)...)
+	LoglnCtx(r.Context(), vals...)
 }
 
-// Logf forwards f and vals to log.Printf and prepends request token
+// Logf forwards f and vals to the current Logger (log.Printf by default, see
+// SetLogger). The default logger prepends the request token; any other
+// Logger gets it only through the request's context (see FromContext).
 func Logf(r *http.Request, f string, vals ...interface{}) {
-	tok := Token(r)
-	f = "%s " + f
-	log.Printf(f, append([]interface{}{tok}, vals...)...)
+	LogfCtx(r.Context(), f, vals...)
+}
+
+// LogCtx is like Log but takes the token from ctx instead of an *http.Request,
+// so it can be used from background goroutines and non-HTTP code paths (DB
+// drivers, gRPC clients, workers) that were handed a context.Context carrying
+// the request token via NewContext.
+func LogCtx(ctx context.Context, vals ...interface{}) {
+	loggerFromContext(ctx).Log(ctx, slog.LevelInfo, fmt.Sprint(vals...))
+}
+
+// LoglnCtx is like Logln but takes the token from ctx instead of an *http.Request.
+func LoglnCtx(ctx context.Context, vals ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintln(vals...), "\n")
+	loggerFromContext(ctx).Log(ctx, slog.LevelInfo, msg)
+}
+
+// LogfCtx is like Logf but takes the token from ctx instead of an *http.Request.
+func LogfCtx(ctx context.Context, f string, vals ...interface{}) {
+	loggerFromContext(ctx).Log(ctx, slog.LevelInfo, fmt.Sprintf(f, vals...))
+}
+
+// Transport is an http.RoundTripper that stamps outbound requests with the
+// token and traceparent carried by the request's context (see
+// OutgoingHeadersForContext) and logs the call's method/URL/status/latency
+// under that same token, so a single grep for the token turns up both a
+// service's inbound handling and everything it fanned out to. This relies on
+// the current Logger (see SetLogger/WithLogger) rendering the "request_id"
+// field it's passed; the default logger does.
+type Transport struct {
+	// Base is the underlying RoundTripper used to perform the request.
+	// http.DefaultTransport is used if Base is nil.
+	Base http.RoundTripper
+}
+
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	token, _ := FromContext(ctx)
+	if token != "" {
+		req = req.Clone(ctx)
+		for k, vs := range OutgoingHeadersForContext(ctx) {
+			for _, v := range vs {
+				req.Header.Set(k, v)
+			}
+		}
+	}
+
+	l := loggerFromContext(ctx)
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		l.Log(ctx, slog.LevelError, "outbound request failed",
+			"method", req.Method, "url", req.URL.String(), "request_id", token,
+			"duration_ms", time.Since(start).Milliseconds(), "error", err.Error())
+		return resp, err
+	}
+	l.Log(ctx, slog.LevelInfo, "outbound request",
+		"method", req.Method, "url", req.URL.String(), "request_id", token,
+		"status", resp.StatusCode, "duration_ms", time.Since(start).Milliseconds())
+	return resp, err
+}
+
+// ctxTransport pins ctx onto every request that goes through it, so that
+// *http.Client methods which build their own request from a bare URL (Get,
+// Post, Head, PostForm) still pick up the trace carried by ctx.
+type ctxTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t ctxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return Transport{Base: t.base}.RoundTrip(req.WithContext(t.ctx))
+}
+
+// Client returns an *http.Client that stamps every outbound request it makes
+// with the token (and traceparent, if any) carried by ctx, via Transport.
+// Build downstream requests with http.NewRequestWithContext(ctx, ...) and a
+// plain http.Client{Transport: trace.Transport{}}, or call methods like
+// Get/Post directly on the client returned here.
+func Client(ctx context.Context) *http.Client {
+	return &http.Client{
+		Transport: ctxTransport{ctx: ctx, base: http.DefaultTransport},
+	}
 }